@@ -0,0 +1,465 @@
+package aim
+
+import (
+	"bitbucket.org/ctessum/sparse"
+	"math"
+)
+
+// ChemMechanism is implemented by gas- and aerosol-phase chemistry
+// schemes that can be substituted for the default VOCoxidationFlux +
+// ChemicalPartitioning combination used in Run. A mechanism is invoked
+// once per grid cell, after transport and wet deposition have already
+// been applied to c, and is expected to update c (indexed as
+// polNames) in place.
+type ChemMechanism interface {
+	Step(m *MetData, c []float64, k, j, i int)
+}
+
+// SetMechanism installs mech as the chemistry scheme Run uses in place
+// of the built-in ChemicalPartitioning step. Passing nil restores the
+// original simplified partitioning behavior.
+func (m *MetData) SetMechanism(mech ChemMechanism) {
+	m.mechanism = mech
+}
+
+// cb05Species are the gas-phase species the CB05 mechanism tracks in
+// addition to the lumped species already in polNames. They are kept
+// in their own state arrays rather than folded into initialConc so
+// that Run's transport loop does not need to know about them, which
+// is only valid for species short-lived enough that ignoring
+// transport doesn't matter. NOx is deliberately NOT tracked here: NO2
+// is not short-lived, and igNO (already transported by Run) is used
+// as the lumped NOx-as-N pool instead of giving NO2 its own
+// untransported reservoir that would quietly leak mass relative to
+// the transported species it reacts with. The NO<->NO2 interconversion
+// reactions (which don't change total NOx) are folded into the
+// reactions below rather than modeled explicitly; see the comments on
+// rates' NOx terms. DMS is deliberately not tracked either: this
+// package has no ocean/background DMS emission source, and a species
+// with no source is dead code, not a cycle.
+var cb05Species = []string{"O3", "OH", "HO2", "RO2", "N2O5"}
+
+const nCB05 = 5
+
+const (
+	icbO3, icbOH, icbHO2, icbRO2, icbN2O5 = 0, 1, 2, 3, 4
+)
+
+// Representative clean/background-troposphere mixing ratios (ppb) used
+// to seed the oxidant pools a fresh CB05Mechanism starts with. Without
+// this, every cell starts at all-zero oxidants and the reaction
+// network is a stable fixed point at zero: there is nothing present to
+// oxidize freshly emitted NOx/VOC/SO2, so nitrate/sulfate/SOA
+// production would never start.
+const (
+	backgroundO3  = 30.   // ppb
+	backgroundOH  = 1.e-4 // ppb, ~2.5e6 molecules/cm3 at sea level
+	backgroundHO2 = 1.e-2 // ppb
+)
+
+// mwVOC is a representative molar mass for the lumped organic species
+// (gOrg/pOrg), used only to convert their μg/m3 mass concentrations to
+// ppb for the reactions in rates().
+const mwVOC = 100. // g/mol
+
+// mechMassSpecies lists the polNames indices rates() reacts with that
+// are stored as mass concentrations (μg/m3, on the molar basis given)
+// rather than mixing ratios; Step converts them to and from ppb around
+// the Newton solve so every species in rates() shares the same units.
+var mechMassSpecies = map[int]float64{
+	igOrg: mwVOC,
+	igNO:  mwN,
+	igS:   mwS,
+	ipOrg: mwVOC,
+	ipNO:  mwN,
+	ipS:   mwS,
+}
+
+const gasConstR = 8.314462618 // J/(mol*K)
+const avogadro = 6.02214076e23
+
+// airMolarDensity returns the molar density of air (mol/m3) at grid
+// cell (k,j,i), from the ideal gas law using m's temperature and
+// pressure.
+func airMolarDensity(m *MetData, k, j, i int) float64 {
+	return m.Pressure(k, j, i) / (gasConstR * m.Temperature(k, j, i))
+}
+
+// massToPPB converts a mass concentration (μg/m3, on the given molar
+// mass basis) to a mixing ratio (ppb) given the air molar density
+// (mol/m3, from airMolarDensity).
+func massToPPB(massUgM3, molWeight, airMolar float64) float64 {
+	return massUgM3 * 1.e-6 / molWeight / airMolar * 1.e9
+}
+
+// ppbToMass is the inverse of massToPPB.
+func ppbToMass(ppb, molWeight, airMolar float64) float64 {
+	return ppb * 1.e-9 * airMolar * molWeight * 1.e6
+}
+
+// effectiveRateConst2 converts a standard bimolecular rate constant k
+// (cm3*molecule^-1*s^-1) into an effective rate constant (ppb^-1*s^-1)
+// for use with mixing-ratio (ppb) concentrations, given the ambient air
+// number density airNumDens (molecules/cm3). Unimolecular rates
+// (photolysis, first-order hydrolysis) need no such conversion, since
+// a mixing-ratio's own decay rate doesn't depend on the units it's
+// expressed in.
+func effectiveRateConst2(k, airNumDens float64) float64 {
+	return k * airNumDens * 1.e-9
+}
+
+// CB05Mechanism is a reduced Carbon Bond 2005 gas-phase mechanism
+// covering O3/NOx/VOC/HOx cycling, N2O5 hydrolysis, and SO2->H2SO4
+// oxidation. The combined state (polNames plus
+// cb05Species) is integrated with a backward-Euler Newton-Raphson
+// solver, following the structure of the WACCM imp_sol scheme: build
+// P(c)/L(c), form J = I/dt - d(P-Lc)/dc, iterate, and halve the
+// substep if the iteration stagnates.
+type CB05Mechanism struct {
+	// gas holds the extra species concentrations (ppb) for every grid
+	// cell, indexed [species][k][j][i].
+	gas []*sparse.DenseArray
+
+	// scratch holds reusable Newton-Raphson buffers, one per x-column,
+	// matching the per-i goroutine concurrency Run already uses so no
+	// goroutine ever touches another's buffers.
+	scratch []*newtonScratch
+
+	maxIter      int
+	substepTries int
+	relTol       float64
+	hardRelTol   float64 // tolerance applied to "hard" species such as O3
+}
+
+// NewCB05Mechanism returns a CB05Mechanism with its state arrays sized
+// for m's grid and default solver tolerances.
+func NewCB05Mechanism(m *MetData) *CB05Mechanism {
+	mech := &CB05Mechanism{
+		gas:          make([]*sparse.DenseArray, nCB05),
+		scratch:      make([]*newtonScratch, m.Nx),
+		maxIter:      11,
+		substepTries: 5,
+		relTol:       1.e-3,
+		hardRelTol:   1.e-4,
+	}
+	for s := range mech.gas {
+		mech.gas[s] = sparse.ZerosDense(m.Nz, m.Ny, m.Nx)
+	}
+	// Seed background oxidants so the reaction network isn't starting
+	// from the all-zero fixed point described above.
+	for k := 0; k < m.Nz; k++ {
+		for j := 0; j < m.Ny; j++ {
+			for i := 0; i < m.Nx; i++ {
+				mech.gas[icbO3].Set(backgroundO3, k, j, i)
+				mech.gas[icbOH].Set(backgroundOH, k, j, i)
+				mech.gas[icbHO2].Set(backgroundHO2, k, j, i)
+			}
+		}
+	}
+	return mech
+}
+
+// newtonScratch holds the Jacobian, its LU factorization, and the
+// production/loss vectors reused across Newton-Raphson iterations so
+// Step never allocates on the hot per-cell path.
+type newtonScratch struct {
+	n     int
+	jac   [][]float64 // J = I/dt - d(P-L*c)/dc
+	lu    [][]float64
+	piv   []int
+	p, l  []float64 // production and loss-rate-coefficient vectors (loss = l*c)
+	fdP, fdL []float64 // scratch for the finite-difference Jacobian
+	y     []float64    // LU forward/back-substitution scratch
+	start []float64    // state at the start of the current Run timestep
+	cOld  []float64    // state at the start of the current substep
+	cNew  []float64    // current Newton iterate
+	delta []float64
+}
+
+func newNewtonScratch(n int) *newtonScratch {
+	jac := make([][]float64, n)
+	lu := make([][]float64, n)
+	for r := range jac {
+		jac[r] = make([]float64, n)
+		lu[r] = make([]float64, n)
+	}
+	return &newtonScratch{
+		n: n, jac: jac, lu: lu, piv: make([]int, n),
+		p: make([]float64, n), l: make([]float64, n),
+		fdP: make([]float64, n), fdL: make([]float64, n),
+		y: make([]float64, n), start: make([]float64, n),
+		cOld: make([]float64, n), cNew: make([]float64, n),
+		delta: make([]float64, n),
+	}
+}
+
+// Step advances the combined (polNames + cb05Species) state at grid
+// cell (k,j,i) by one Run timestep, halving the substep and retrying
+// if the Newton iteration fails to converge within maxIter iterations,
+// for at most substepTries attempts in all (the first, full-step
+// attempt included).
+func (mech *CB05Mechanism) Step(m *MetData, c []float64, k, j, i int) {
+	n := len(polNames) + nCB05
+	if mech.scratch[i] == nil {
+		mech.scratch[i] = newNewtonScratch(n)
+	}
+	s := mech.scratch[i]
+
+	// rates() is written entirely in mixing-ratio (ppb) terms, since
+	// that's what the cb05Species oxidants are tracked in; convert the
+	// mass-concentration (μg/m3) polNames species it reacts with to
+	// ppb for the solve and back to mass on the way out, so no step
+	// ever multiplies a ppb quantity by a μg/m3 one.
+	airMolar := airMolarDensity(m, k, j, i)
+	airNumDens := airMolar * avogadro / 1.e6 // molecules/cm3
+
+	for q := range polNames {
+		if mw, ok := mechMassSpecies[q]; ok {
+			s.start[q] = massToPPB(c[q], mw, airMolar)
+		} else {
+			s.start[q] = c[q]
+		}
+	}
+	for q := 0; q < nCB05; q++ {
+		s.start[len(polNames)+q] = mech.gas[q].Get(k, j, i)
+	}
+
+	dt := m.Dt
+	converged := false
+	for try := 0; try < mech.substepTries && !converged; try++ {
+		nsub := 1 << uint(try)
+		sub := dt / float64(nsub)
+		copy(s.cOld, s.start)
+		converged = true
+		for step := 0; step < nsub; step++ {
+			copy(s.cNew, s.cOld)
+			if !mech.newtonSolve(s, sub, airNumDens) {
+				converged = false
+				break
+			}
+			copy(s.cOld, s.cNew)
+		}
+	}
+	if !converged {
+		// Out of substep budget: hold chemistry steady for this cell
+		// and timestep rather than propagate a diverged solution.
+		copy(s.cNew, s.start)
+	}
+
+	for q := range polNames {
+		if mw, ok := mechMassSpecies[q]; ok {
+			c[q] = math.Max(0, ppbToMass(s.cNew[q], mw, airMolar))
+		} else {
+			c[q] = math.Max(0, s.cNew[q])
+		}
+	}
+	for q := 0; q < nCB05; q++ {
+		mech.gas[q].Set(math.Max(0, s.cNew[len(polNames)+q]), k, j, i)
+	}
+}
+
+// newtonSolve advances s.cOld to s.cNew over a step of length dt using
+// backward-Euler Newton-Raphson:
+//
+//	c_k+1 = c_k - J^-1 * ((c_k - cOld)/dt - (P(c_k) - L(c_k)*c_k))
+//
+// It returns false if the relative change per species has not dropped
+// below tolerance within maxIter iterations.
+func (mech *CB05Mechanism) newtonSolve(s *newtonScratch, dt, airNumDens float64) bool {
+	for iter := 0; iter < mech.maxIter; iter++ {
+		rates(s.cNew, s.p, s.l, airNumDens)
+		for r := 0; r < s.n; r++ {
+			for cc := 0; cc < s.n; cc++ {
+				s.jac[r][cc] = -jacobianTerm(s.cNew, r, cc, s.fdP, s.fdL, airNumDens)
+			}
+			s.jac[r][r] += 1. / dt
+			s.delta[r] = (s.cNew[r]-s.cOld[r])/dt - (s.p[r] - s.l[r]*s.cNew[r])
+		}
+		if !luDecompose(s.jac, s.lu, s.piv) {
+			return false
+		}
+		luSolve(s.lu, s.piv, s.delta, s.y)
+
+		allTight := true
+		for q := 0; q < s.n; q++ {
+			s.cNew[q] -= s.delta[q]
+			if s.cNew[q] < 0 {
+				s.cNew[q] = 0
+			}
+			tol := mech.relTol
+			if q == len(polNames)+icbO3 {
+				tol = mech.hardRelTol
+			}
+			if math.Abs(s.delta[q])/math.Max(s.cNew[q], 1.e-12) > tol {
+				allTight = false
+			}
+		}
+		if allTight {
+			return true
+		}
+	}
+	return false
+}
+
+// no2FracOfNOx approximates the photostationary NO2/NOx ratio, used so
+// reactions that actually consume NO2 specifically (HNO3 and N2O5
+// formation) draw from the lumped NOx (igNO) pool at roughly the right
+// rate without giving NO2 its own untransported reservoir. Reactions
+// that only interconvert NO and NO2 (RO2+NO, HO2+NO) don't change
+// total NOx and so need no NOx loss term at all.
+const no2FracOfNOx = 0.7
+
+// rates computes the production vector p and loss-rate-coefficient
+// vector l (loss = l[q]*c[q]) for the combined state vector c, which
+// holds the len(polNames) lumped species followed by the nCB05 extra
+// gas species in cb05Species, all as mixing ratios (ppb) — see Step,
+// which converts the mass-concentration (μg/m3) polNames species to
+// ppb before calling rates and back to mass afterward, so every
+// species here shares the same units. Rate constants are representative
+// 298K/1atm values for a reduced reaction set; this is not a
+// substitute for a full CB05 mechanism, but it is enough to let
+// nitrate/sulfate/SOA formation respond to oxidant levels instead of
+// the fixed ratios ChemicalPartitioning uses.
+func rates(c, p, l []float64, airNumDens float64) {
+	const off = 9 // len(polNames)
+	for q := range p {
+		p[q] = 0
+		l[q] = 0
+	}
+
+	// NOx + OH -> HNO3, deposited straight to particulate nitrate
+	// (N-mass basis, matching igNO/ipNO). OH is consumed 1:1 with the
+	// NOx it reacts with.
+	k2 := effectiveRateConst2(1.1e-11, airNumDens)
+	lossRate2 := k2 * no2FracOfNOx * c[off+icbOH]
+	l[igNO] += lossRate2
+	l[off+icbOH] += k2 * no2FracOfNOx * c[igNO]
+	p[ipNO] += lossRate2 * c[igNO]
+
+	// NOx + O3 -> NO3 -> (+NO2) -> N2O5 (lumped single step). N2O5 is
+	// produced and tracked here in the same N-mass-equivalent basis as
+	// igNO/ipNO (not molar concentration), so this and the hydrolysis
+	// step below are both plain 1:1 N-mass transfers with no
+	// stoichiometric factor needed for N2O5's two nitrogens.
+	k3 := effectiveRateConst2(3.2e-17, airNumDens)
+	lossRate3 := k3 * no2FracOfNOx * c[off+icbO3]
+	l[igNO] += lossRate3
+	l[off+icbO3] += k3 * no2FracOfNOx * c[igNO]
+	p[off+icbN2O5] += lossRate3 * c[igNO]
+
+	// NO2 (the no2FracOfNOx fraction of NOx) + hv -> NO + O3
+	// (daytime-averaged photolysis rate). NO recombines into the same
+	// untracked NOx family, so this only produces O3; it does not
+	// touch igNO. This is O3's only source in the mechanism, balancing
+	// the O3 the reaction above consumes.
+	const jNO2 = 8.e-3
+	p[off+icbO3] += jNO2 * no2FracOfNOx * c[igNO]
+
+	// N2O5 + H2O (aerosol surface) -> 2 HNO3, as particulate nitrate
+	const kN2O5 = 2.e-5
+	l[off+icbN2O5] += kN2O5
+	p[ipNO] += kN2O5 * c[off+icbN2O5]
+
+	// VOC (gOrg) + OH -> RO2
+	k4 := effectiveRateConst2(4.e-12, airNumDens)
+	l[igOrg] += k4 * c[off+icbOH]
+	l[off+icbOH] += k4 * c[igOrg]
+	p[off+icbRO2] += k4 * c[igOrg] * c[off+icbOH]
+
+	// RO2 + NOx -> HO2 + SOA. This also turns NO into NO2 within the
+	// NOx family, which isn't tracked separately, so it carries no
+	// igNO loss term.
+	k5 := effectiveRateConst2(9.e-12, airNumDens)
+	r5 := k5 * c[off+icbRO2] * c[igNO]
+	l[off+icbRO2] += k5 * c[igNO]
+	p[off+icbHO2] += r5
+	p[ipOrg] += 0.1 * r5
+
+	// HO2 + NOx -> OH (HOx recycling). Also NO->NO2 within the NOx
+	// family, so no igNO loss term.
+	k6 := effectiveRateConst2(8.e-12, airNumDens)
+	r6 := k6 * c[off+icbHO2] * c[igNO]
+	l[off+icbHO2] += k6 * c[igNO]
+	p[off+icbOH] += r6
+
+	// SO2 + OH -> H2SO4, deposited straight to particulate sulfate
+	k8 := effectiveRateConst2(9.e-13, airNumDens)
+	l[igS] += k8 * c[off+icbOH]
+	l[off+icbOH] += k8 * c[igS]
+	p[ipS] += k8 * c[igS] * c[off+icbOH]
+}
+
+// jacobianTerm returns an approximate d(P-L*c)[r]/dc[cc] by centered
+// finite differences, using p and l as scratch buffers. At this
+// mechanism's size (~15 species) recomputing rates() for every
+// Jacobian entry is cheap and avoids hand-maintaining analytic
+// partials for every reaction as the mechanism grows.
+func jacobianTerm(c []float64, r, cc int, p, l []float64, airNumDens float64) float64 {
+	const h = 1.e-6
+	orig := c[cc]
+	step := h * math.Max(math.Abs(orig), 1.)
+
+	c[cc] = orig + step
+	rates(c, p, l, airNumDens)
+	fPlus := p[r] - l[r]*c[r]
+
+	c[cc] = orig - step
+	rates(c, p, l, airNumDens)
+	fMinus := p[r] - l[r]*c[r]
+
+	c[cc] = orig
+	return (fPlus - fMinus) / (2 * step)
+}
+
+// luDecompose computes an in-place LU factorization of a into lu with
+// partial pivoting, recording the pivot order in piv. It returns false
+// if a is numerically singular, which Step treats as a failed substep.
+func luDecompose(a, lu [][]float64, piv []int) bool {
+	n := len(a)
+	for r := 0; r < n; r++ {
+		copy(lu[r], a[r])
+		piv[r] = r
+	}
+	for col := 0; col < n; col++ {
+		maxRow, maxVal := col, math.Abs(lu[col][col])
+		for r := col + 1; r < n; r++ {
+			if v := math.Abs(lu[r][col]); v > maxVal {
+				maxRow, maxVal = r, v
+			}
+		}
+		if maxVal < 1.e-300 {
+			return false
+		}
+		if maxRow != col {
+			lu[col], lu[maxRow] = lu[maxRow], lu[col]
+			piv[col], piv[maxRow] = piv[maxRow], piv[col]
+		}
+		for r := col + 1; r < n; r++ {
+			factor := lu[r][col] / lu[col][col]
+			lu[r][col] = factor
+			for cc := col + 1; cc < n; cc++ {
+				lu[r][cc] -= factor * lu[col][cc]
+			}
+		}
+	}
+	return true
+}
+
+// luSolve solves lu*x = b, writing the solution into b and using y as
+// scratch space, undoing the row pivoting recorded by luDecompose.
+func luSolve(lu [][]float64, piv []int, b, y []float64) {
+	n := len(lu)
+	for r := 0; r < n; r++ {
+		y[r] = b[piv[r]]
+		for cc := 0; cc < r; cc++ {
+			y[r] -= lu[r][cc] * y[cc]
+		}
+	}
+	for r := n - 1; r >= 0; r-- {
+		for cc := r + 1; cc < n; cc++ {
+			y[r] -= lu[r][cc] * y[cc]
+		}
+		y[r] /= lu[r][r]
+	}
+	copy(b, y)
+}
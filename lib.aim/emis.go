@@ -0,0 +1,198 @@
+package aim
+
+import (
+	"bitbucket.org/ctessum/sparse"
+)
+
+// SectorEmissions is one emissions sector's 2-D surface flux (μg/s,
+// Ny x Nx) plus the name of the vertical profile calcEmisFlux should
+// use to distribute it through the column. Profile may be left empty,
+// in which case calcEmisFlux looks it up from sectorDefaultProfile by
+// the sector's map key (e.g. "ENE", "TRA").
+type SectorEmissions struct {
+	Flux    *sparse.DenseArray // 2-D, Ny x Nx
+	Profile string
+}
+
+// Recognized emissions sectors and the vertical profile each defaults
+// to when a SectorEmissions doesn't set Profile explicitly.
+var sectorDefaultProfile = map[string]string{
+	"ENE":  "stack",   // energy/power generation: elevated stack
+	"IND":  "stack",   // industry: elevated stack
+	"DOM":  "surface", // domestic/residential
+	"TRA":  "surface", // transport
+	"SHP":  "surface", // shipping
+	"AIR":  "cruise",  // aviation: jet-cruise layers
+	"AGR":  "surface", // agriculture
+	"WST":  "surface", // waste
+	"BB":   "pblTop",  // biomass burning: injected near PBL top
+	"SOIL": "surface", // soil
+	"BIO":  "surface", // biogenic
+}
+
+// verticalWeights returns normalized per-layer weights (summing to 1)
+// for the named vertical profile over a column of nz layers. Profiles
+// are deliberately simple single-layer injections; callers wanting a
+// smoother distribution can pre-spread their 2-D flux across several
+// sectors with different profiles instead.
+func verticalWeights(profile string, nz int) []float64 {
+	w := make([]float64, nz)
+	k := 0
+	switch profile {
+	case "surface":
+		k = 0
+	case "stack":
+		k = nz / 4
+	case "cruise":
+		k = nz * 3 / 4
+	case "pblTop":
+		k = nz * 3 / 5
+	default:
+		k = 0
+	}
+	if k >= nz {
+		k = nz - 1
+	}
+	w[k] = 1.
+	return w
+}
+
+// calcEmisFlux distributes each sector's 2-D surface flux (μg/s)
+// through the column using its named vertical profile, sums the
+// sectors, applies scale for molecular mass conversion, and converts
+// to the μg/m3-per-timestep flux Run adds into initialConc.
+func (m *MetData) calcEmisFlux(sectors map[string]SectorEmissions, scale float64) (
+	emisFlux *sparse.DenseArray) {
+	emisFlux = sparse.ZerosDense(m.Nz, m.Ny, m.Nx)
+	for name, sector := range sectors {
+		profile := sector.Profile
+		if profile == "" {
+			profile = sectorDefaultProfile[name]
+		}
+		weights := verticalWeights(profile, m.Nz)
+		for k := 0; k < m.Nz; k++ {
+			if weights[k] == 0 {
+				continue
+			}
+			for j := 0; j < m.Ny; j++ {
+				for i := 0; i < m.Nx; i++ {
+					fluxScale := 1. / m.Dx / m.Dy / m.Dz.Get(k, j, i) * m.Dt
+					v := sector.Flux.Get(j, i) * weights[k] * scale * fluxScale
+					emisFlux.Set(emisFlux.Get(k, j, i)+v, k, j, i)
+				}
+			}
+		}
+	}
+	return
+}
+
+// LightningConfig configures the online lightning-NOx source enabled
+// by MetData.EnableLightningNOx.
+type LightningConfig struct {
+	AnnualGlobalTgN float64 // default 5.
+
+	// DomainFraction is this domain's share (0-1) of AnnualGlobalTgN:
+	// addLightningNOx deposits AnnualGlobalTgN*DomainFraction into this
+	// domain's grid over a year, not the full global total, since most
+	// InMAP domains cover a single region or continent rather than the
+	// whole Earth. Left at zero, it defaults to the domain grid's share
+	// of Earth's surface area, a reasonable first-order stand-in for a
+	// real convective-activity climatology; callers modeling a
+	// domain with disproportionately more or less lightning than its
+	// area alone would suggest should set it explicitly (or set it to
+	// 1 and pre-scale AnnualGlobalTgN themselves).
+	DomainFraction float64
+}
+
+// DefaultLightningConfig returns the standard ~5 Tg N/yr global
+// lightning-NOx source strength, with DomainFraction left at its
+// area-based default.
+func DefaultLightningConfig() LightningConfig {
+	return LightningConfig{AnnualGlobalTgN: 5.}
+}
+
+// EnableLightningNOx turns on the online lightning-NOx source: Run
+// will deposit NO directly into initialConc[igNO] each iteration
+// instead of relying on lightning having been pre-baked into the
+// NOx emissions.
+func (m *MetData) EnableLightningNOx(cfg LightningConfig) {
+	m.lightning = &cfg
+}
+
+// cShapeProfile returns normalized weights across layers [base, top]
+// following the classic lightning-NOx "C" shape: most mass near cloud
+// base and in the anvil near cloud top, least in between.
+func cShapeProfile(base, top, nz int) []float64 {
+	w := make([]float64, nz)
+	if top <= base || top >= nz {
+		return w
+	}
+	span := float64(top - base)
+	sum := 0.
+	for k := base; k <= top; k++ {
+		frac := (float64(k-base)/span-0.5)*2 // -1 at base, +1 at top
+		w[k] = 0.3 + 0.7*frac*frac            // parabola: high at ends, low in the middle
+		sum += w[k]
+	}
+	for k := base; k <= top; k++ {
+		w[k] /= sum
+	}
+	return w
+}
+
+// earthSurfaceAreaM2 is Earth's total surface area, used by
+// addLightningNOx to approximate a domain's share of global lightning
+// NOx activity when LightningConfig.DomainFraction is left at zero.
+const earthSurfaceAreaM2 = 5.1007e14
+
+// addLightningNOx deposits NO directly into initialConc[igNO] for the
+// current iteration, following a C-shape vertical profile between
+// cloud base and the anvil in every convectively active column, scaled
+// so that, integrated over a year, the whole domain produces this
+// domain's share (m.lightning.DomainFraction) of
+// m.lightning.AnnualGlobalTgN teragrams of N — not the full global
+// total, which would grossly overstate lightning NOx for any
+// sub-global domain. It is a no-op unless EnableLightningNOx has been
+// called.
+func (m *MetData) addLightningNOx(initialConc []*sparse.DenseArray, dt float64) {
+	if m.lightning == nil {
+		return
+	}
+	domainFraction := m.lightning.DomainFraction
+	if domainFraction <= 0 {
+		domainArea := m.Dx * m.Dy * float64(m.Nx) * float64(m.Ny)
+		domainFraction = domainArea / earthSurfaceAreaM2
+	}
+	gPerSecond := m.lightning.AnnualGlobalTgN * domainFraction * 1.e12 / (365.25 * 24 * 3600) // Tg N/yr -> g N/s
+
+	nCells := 0
+	for j := 0; j < m.Ny; j++ {
+		for i := 0; i < m.Nx; i++ {
+			if top := m.CloudTopLayer(j, i); top > m.CloudBaseLayer(j, i) {
+				nCells++
+			}
+		}
+	}
+	if nCells == 0 {
+		return
+	}
+	gPerSecondPerColumn := gPerSecond / float64(nCells)
+
+	for j := 0; j < m.Ny; j++ {
+		for i := 0; i < m.Nx; i++ {
+			base, top := m.CloudBaseLayer(j, i), m.CloudTopLayer(j, i)
+			if top <= base {
+				continue
+			}
+			weights := cShapeProfile(base, top, m.Nz)
+			for k := base; k <= top && k < m.Nz; k++ {
+				if weights[k] == 0 {
+					continue
+				}
+				massAddedG := gPerSecondPerColumn * weights[k] * dt
+				concAddedUgPerM3 := massAddedG * 1.e6 / (m.Dx * m.Dy * m.Dz.Get(k, j, i))
+				initialConc[igNO].Set(initialConc[igNO].Get(k, j, i)+concAddedUgPerM3, k, j, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package aim
+
+import (
+	"bitbucket.org/ctessum/sparse"
+	"fmt"
+	"math"
+)
+
+// OpticsTables holds pre-computed Mie-theory lookup tables (mass
+// extinction efficiency, single scattering albedo, and asymmetry
+// parameter) for each aerosol species, dry radius bin, RH bin, and
+// wavelength, following the GEOS chemistry/Mie-table approach.
+type OpticsTables struct {
+	Species     []string  // e.g. "PrimaryPM2_5", "SOA", "pNH4", "pSO4", "pNO3"
+	DryRadii    []float64 // m, bin centers
+	RH          []float64 // 0-1, bin centers
+	Wavelengths []float64 // nm, table axis
+
+	// MassExtEff[species][radius][rh][wavelength] is the mass
+	// extinction efficiency (m2/g).
+	MassExtEff [][][][]float64
+	// SingleScatAlbedo[species][radius][rh][wavelength] is dimensionless.
+	SingleScatAlbedo [][][][]float64
+	// AsymParam[species][radius][rh][wavelength] is the Mie asymmetry
+	// parameter g.
+	AsymParam [][][][]float64
+}
+
+// interpolate returns the mass extinction efficiency (m2/g), single
+// scattering albedo, and asymmetry parameter for species at ambient RH
+// and wavelength, using nearest-bin lookup against the table's RH and
+// wavelength axes. Mass extinction efficiency also depends on dry
+// radius; lacking a per-cell size distribution for the bulk species
+// Run reports, interpolate uses the table's first (accumulation-mode)
+// radius bin.
+func (t OpticsTables) interpolate(species string, rh, wavelength float64) (massExtEff, ssa, g float64) {
+	si := indexOf(t.Species, species)
+	if si < 0 {
+		return 0, 0, 0
+	}
+	ri := nearestIndex(t.RH, rh)
+	wi := nearestIndex(t.Wavelengths, wavelength)
+	return t.MassExtEff[si][0][ri][wi], t.SingleScatAlbedo[si][0][ri][wi], t.AsymParam[si][0][ri][wi]
+}
+
+func indexOf(names []string, name string) int {
+	for idx, n := range names {
+		if n == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+func nearestIndex(axis []float64, v float64) int {
+	best, bestDist := 0, math.Inf(1)
+	for idx, a := range axis {
+		if d := math.Abs(a - v); d < bestDist {
+			best, bestDist = idx, d
+		}
+	}
+	return best
+}
+
+// opticsBulkSpecies are the outputConc entries ComputeOptics reads
+// aerosol mass from. When aerosol microphysics is enabled, Run folds
+// AerosolState's per-bin masses into these bulk entries (see
+// AerosolState.AddBulkMass) before calling ComputeOptics; this reduced
+// implementation does not walk AerosolState's bins directly, so it
+// cannot resolve AOD/SSA by dry-radius bin the way a full Mie
+// treatment of the sectional scheme would.
+var opticsBulkSpecies = []string{"PrimaryPM2_5", "SOA", "pNH4", "pSO4", "pNO3"}
+
+// OpticsOutput holds the optical properties ComputeOptics derives,
+// keyed by the wavelength (nm, rounded to the nearest integer) they
+// were computed at. AOD, SSA, and AsymParam are column values
+// (Ny x Nx, AsymParam dimensionless); ExtCoef is per layer
+// (Nz x Ny x Nx, m^-1).
+type OpticsOutput struct {
+	AOD       map[int]*sparse.DenseArray
+	SSA       map[int]*sparse.DenseArray
+	ExtCoef   map[int]*sparse.DenseArray
+	AsymParam map[int]*sparse.DenseArray
+}
+
+// opticsConfig is the state installed by EnableOptics.
+type opticsConfig struct {
+	tables      OpticsTables
+	wavelengths []float64
+}
+
+// EnableOptics turns on end-of-Run optical-properties output: Run will
+// call ComputeOptics on the final concentrations and merge its results
+// into outputConc as AOD<wl>, SSA<wl>, ExtCoef<wl>, and AsymParam<wl>
+// for each wavelength in wavelengths.
+func (m *MetData) EnableOptics(wavelengths []float64, tables OpticsTables) {
+	m.optics = &opticsConfig{tables: tables, wavelengths: wavelengths}
+}
+
+// ComputeOptics converts the aerosol mass fields in conc (PrimaryPM2_5,
+// SOA, pNH4, pSO4, and pNO3, as produced by Run) into column AOD, SSA,
+// and asymmetry parameter and per-layer extinction coefficient at each
+// of wavelengths, looking opticsTables up by species and by the
+// nearest table bin to the RH derived from m's temperature/humidity
+// fields and to each wavelength. It does not interpolate between
+// table bins and does not vary the dry radius bin: every lookup uses
+// the table's first radius bin (see interpolate).
+func (m *MetData) ComputeOptics(conc map[string]*sparse.DenseArray, wavelengths []float64, opticsTables OpticsTables) OpticsOutput {
+	out := OpticsOutput{
+		AOD:       make(map[int]*sparse.DenseArray),
+		SSA:       make(map[int]*sparse.DenseArray),
+		ExtCoef:   make(map[int]*sparse.DenseArray),
+		AsymParam: make(map[int]*sparse.DenseArray),
+	}
+
+	for _, wl := range wavelengths {
+		ext := sparse.ZerosDense(m.Nz, m.Ny, m.Nx)
+		scatExt := sparse.ZerosDense(m.Nz, m.Ny, m.Nx)  // extinction*SSA, for column SSA averaging
+		asymExt := sparse.ZerosDense(m.Nz, m.Ny, m.Nx) // extinction*SSA*g, for column g averaging
+
+		for _, species := range opticsBulkSpecies {
+			arr, ok := conc[species]
+			if !ok {
+				continue
+			}
+			for k := 0; k < m.Nz; k++ {
+				for j := 0; j < m.Ny; j++ {
+					for i := 0; i < m.Nx; i++ {
+						rh := m.RelativeHumidity(k, j, i)
+						massExt, ssa, g := opticsTables.interpolate(species, rh, wl)
+						cellExt := arr.Get(k, j, i) * massExt * 1.e-6 // μg/m3 * m2/g -> m^-1
+						ext.Set(ext.Get(k, j, i)+cellExt, k, j, i)
+						scatExt.Set(scatExt.Get(k, j, i)+cellExt*ssa, k, j, i)
+						asymExt.Set(asymExt.Get(k, j, i)+cellExt*ssa*g, k, j, i)
+					}
+				}
+			}
+		}
+
+		aod := sparse.ZerosDense(m.Ny, m.Nx)
+		ssaCol := sparse.ZerosDense(m.Ny, m.Nx)
+		gCol := sparse.ZerosDense(m.Ny, m.Nx)
+		for j := 0; j < m.Ny; j++ {
+			for i := 0; i < m.Nx; i++ {
+				var colExt, colScat, colAsym float64
+				for k := 0; k < m.Nz; k++ {
+					colExt += ext.Get(k, j, i) * m.Dz.Get(k, j, i)
+					colScat += scatExt.Get(k, j, i) * m.Dz.Get(k, j, i)
+					colAsym += asymExt.Get(k, j, i) * m.Dz.Get(k, j, i)
+				}
+				aod.Set(colExt, j, i)
+				if colExt > 0 {
+					ssaCol.Set(colScat/colExt, j, i)
+				}
+				if colScat > 0 {
+					gCol.Set(colAsym/colScat, j, i)
+				}
+			}
+		}
+
+		wlKey := int(wl + 0.5)
+		out.AOD[wlKey] = aod
+		out.SSA[wlKey] = ssaCol
+		out.ExtCoef[wlKey] = ext
+		out.AsymParam[wlKey] = gCol
+	}
+
+	return out
+}
+
+// mergeOpticsOutput writes opt's per-wavelength fields into outputConc
+// under the names Run documents: AOD<wl>, SSA<wl>, ExtCoef<wl>, and
+// AsymParam<wl>.
+func mergeOpticsOutput(outputConc map[string]*sparse.DenseArray, opt OpticsOutput) {
+	for wl, arr := range opt.AOD {
+		outputConc[fmt.Sprintf("AOD%d", wl)] = arr
+	}
+	for wl, arr := range opt.SSA {
+		outputConc[fmt.Sprintf("SSA%d", wl)] = arr
+	}
+	for wl, arr := range opt.ExtCoef {
+		outputConc[fmt.Sprintf("ExtCoef%d", wl)] = arr
+	}
+	for wl, arr := range opt.AsymParam {
+		outputConc[fmt.Sprintf("AsymParam%d", wl)] = arr
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bitbucket.org/ctessum/sparse"
 	"fmt"
 	"math"
+	"time"
 )
 
 // Chemical mass conversions
@@ -48,25 +49,92 @@ const (
 var OutputNames = []string{"VOC", "SOA", "PrimaryPM2_5", "NH3", "pNH4",
 	"SOx", "pSO4", "NOx", "pNO3", "TotalPM2_5"}
 
+// AerosolOutputNames are additional outputs Run produces when
+// EnableAerosolMicrophysics has been called: N_UFP is in particles/cm3,
+// PM0_1/PM1/PM10 are in μg/m3.
+var AerosolOutputNames = []string{"N_UFP", "PM0_1", "PM1", "PM10"}
+
+// ConvergenceConfig controls when Run decides a pollutant, and the
+// simulation as a whole, has converged.
+type ConvergenceConfig struct {
+	// Tol is the default relative-bias tolerance applied to
+	// |newSum-oldSum|/max(oldSum,eps); it is overridden per pollutant
+	// by PerPollutantTol.
+	Tol float64
+	// PerPollutantTol overrides Tol for specific pollutants, keyed by
+	// the names in polNames (e.g. "pNO").
+	PerPollutantTol map[string]float64
+	// ConsecutiveBelowTol is the number of consecutive iterations a
+	// pollutant's bias must stay below tolerance before it counts as
+	// converged, so a single quiet iteration can't end the run early.
+	ConsecutiveBelowTol int
+	MaxIterations       int
+	MinDays             float64
+	MaxDays             float64
+}
+
+// DefaultConvergenceConfig returns a 1e-3 relative tolerance, three
+// consecutive quiet iterations required, a cap of 100000 iterations,
+// no maximum run length, and the original 15-day (NdaysToRun) minimum
+// run length.
+func DefaultConvergenceConfig() ConvergenceConfig {
+	return ConvergenceConfig{
+		Tol:                 1.e-3,
+		ConsecutiveBelowTol: 3,
+		MaxIterations:       100000,
+		MinDays:             NdaysToRun,
+		MaxDays:             math.Inf(1),
+	}
+}
+
+// SetConvergenceConfig overrides the default tolerances and iteration
+// limits Run uses to decide when to stop iterating.
+func (m *MetData) SetConvergenceConfig(cfg ConvergenceConfig) {
+	m.convergence = &cfg
+}
+
+// RunReport summarizes how Run's iteration loop ended: the final
+// relative bias and convergence state of every pollutant, how many
+// iterations ran, and how long it took, so callers can detect
+// non-convergence programmatically instead of relying on stdout
+// prints.
+type RunReport struct {
+	Pollutant  []string
+	FinalBias  []float64
+	Converged  []bool
+	Iterations int
+	WallTime   time.Duration
+}
+
 // Run air quality model. Emissions are assumed to be in units
 // of μg/s, and must only include the pollutants listed in "EmisNames".
-func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
-	outputConc map[string]*sparse.DenseArray) {
+// Each pollutant's emissions are given as a map of sectors (e.g. "ENE",
+// "TRA") to SectorEmissions so calcEmisFlux can apply a per-sector
+// vertical profile instead of treating every sector the same.
+func (m *MetData) Run(emissions map[string]map[string]SectorEmissions) (
+	outputConc map[string]*sparse.DenseArray, report RunReport) {
+
+	startTime := time.Now()
+	cfg := m.convergence
+	if cfg == nil {
+		d := DefaultConvergenceConfig()
+		cfg = &d
+	}
 
 	// Emissions: all except PM2.5 go to gas phase
 	emisFlux := make(map[string]*sparse.DenseArray)
-	for pol, arr := range emissions {
+	for pol, sectors := range emissions {
 		switch pol {
 		case "VOC":
-			emisFlux["gOrg"] = m.calcEmisFlux(arr, 1.)
+			emisFlux["gOrg"] = m.calcEmisFlux(sectors, 1.)
 		case "NOx":
-			emisFlux["gNO"] = m.calcEmisFlux(arr, NOxToN)
+			emisFlux["gNO"] = m.calcEmisFlux(sectors, NOxToN)
 		case "NH3":
-			emisFlux["gNH"] = m.calcEmisFlux(arr, NH3ToN)
+			emisFlux["gNH"] = m.calcEmisFlux(sectors, NH3ToN)
 		case "SOx":
-			emisFlux["gS"] = m.calcEmisFlux(arr, SOxToS)
+			emisFlux["gS"] = m.calcEmisFlux(sectors, SOxToS)
 		case "PM2_5":
-			emisFlux["PM2_5"] = m.calcEmisFlux(arr, 1.)
+			emisFlux["PM2_5"] = m.calcEmisFlux(sectors, 1.)
 		default:
 			panic(fmt.Sprintf("Unknown emissions pollutant %v.", pol))
 		}
@@ -85,9 +153,12 @@ func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
 	}
 
 	polsConverged := make([]bool, len(polNames)) // whether pollutant arrays have converged.
+	belowTolStreak := make([]int, len(polNames))
+	bias := make([]float64, len(polNames))
 
 	iteration := 0
 	nDaysRun := 0.
+	timeToQuit := false
 	for {
 		iteration++
 		nDaysRun += m.Dt * secondsPerDay
@@ -100,6 +171,8 @@ func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
 			}
 		}
 
+		m.addLightningNOx(initialConc, m.Dt)
+
 		m.newRand() // set new random number
 
 		// Calculate minimum value which is to be considered nonzero
@@ -139,9 +212,20 @@ func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
 							var VOCoxidation float64
 							switch q {
 							case iPM2_5, ipOrg, ipNH, ipNO, ipS:
-								gravSettling = m.GravitationalSettling(c, k)
+								// When sectional aerosol microphysics is
+								// enabled, gravitational settling of
+								// particulate mass is handled per-bin by
+								// AerosolState.Transport instead, using
+								// each bin's own Stokes+Cunningham
+								// settling velocity rather than this
+								// fixed scalar rate.
+								if m.aerosol == nil {
+									gravSettling = m.GravitationalSettling(c, k)
+								}
 							case igOrg:
-								VOCoxidation = m.VOCoxidationFlux(c)
+								if m.mechanism == nil {
+									VOCoxidation = m.VOCoxidationFlux(c)
+								}
 							}
 
 							tempconc[q] = Carr.Get(k, j, i) +
@@ -149,7 +233,26 @@ func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
 									zdiff)
 						}
 						m.WetDeposition(tempconc, k, j, i)
-						m.ChemicalPartitioning(tempconc, k, j, i)
+						if m.mechanism != nil {
+							m.mechanism.Step(m, tempconc, k, j, i)
+						} else {
+							m.ChemicalPartitioning(tempconc, k, j, i)
+						}
+
+						if m.aerosol != nil {
+							rh := m.RelativeHumidity(k, j, i)
+							m.aerosol.Transport(m, k, j, i, rh, U, Unext, V, Vnext, W, Wnext, d, calcMin)
+
+							// cond holds the gas-phase precursors
+							// (H2SO4, HNO3, NH3, LV-SOA) condensation
+							// draws down, not the particulate pools
+							// those gases eventually feed.
+							cond := []float64{tempconc[igS], tempconc[igNO],
+								tempconc[igNH], tempconc[igOrg]}
+							m.aerosol.Step(m.Dt, rh, cond, k, j, i)
+							tempconc[igS], tempconc[igNO] = cond[0], cond[1]
+							tempconc[igNH], tempconc[igOrg] = cond[2], cond[3]
+						}
 
 						for q, val := range tempconc {
 							finalConc[q].Set(val, k, j, i)
@@ -162,25 +265,42 @@ func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
 		for i := 1; i < m.Nx-1; i++ { // wait for routines to finish
 			<-sem
 		}
-		timeToQuit := true
+		timeToQuit = true
 		for q, polConverged := range polsConverged {
 			arrSum := finalConc[q].Sum()
 			if !polConverged {
-				polsConverged[q] = checkConvergence(arrSum,
-					oldFinalConcSum[q], polNames[q])
-				if !polsConverged[q] {
+				tol := cfg.Tol
+				if t, ok := cfg.PerPollutantTol[polNames[q]]; ok {
+					tol = t
+				}
+				b, ok := checkConvergence(arrSum, oldFinalConcSum[q], tol)
+				bias[q] = b
+				if ok {
+					belowTolStreak[q]++
+				} else {
+					belowTolStreak[q] = 0
+				}
+				if belowTolStreak[q] >= cfg.ConsecutiveBelowTol {
+					polsConverged[q] = true
+				} else {
 					timeToQuit = false
 				}
 			}
 			oldFinalConcSum[q] = arrSum
 		}
-		if timeToQuit && nDaysRun > NdaysToRun {
+		if iteration >= cfg.MaxIterations || nDaysRun >= cfg.MaxDays {
+			break
+		}
+		if timeToQuit && nDaysRun > cfg.MinDays {
 			break
 		}
 		for q, _ := range finalConc {
 			initialConc[q] = finalConc[q].Copy()
 			finalConc[q] = sparse.ZerosDense(m.Nz, m.Ny, m.Nx)
 		}
+		if m.aerosol != nil {
+			m.aerosol.SwapBuffers(m)
+		}
 	}
 	outputConc = make(map[string]*sparse.DenseArray)
 	outputConc["VOC"] = finalConc[igOrg]                       // gOrg
@@ -192,29 +312,36 @@ func (m *MetData) Run(emissions map[string]*sparse.DenseArray) (
 	outputConc["pSO4"] = finalConc[ipS].ScaleCopy(StoSO4)      // pS
 	outputConc["NOx"] = finalConc[igNO].ScaleCopy(1. / NOxToN) // gNO
 	outputConc["pNO3"] = finalConc[ipNO].ScaleCopy(NtoNO3)     // pNO
+
+	if m.aerosol != nil {
+		for name, arr := range m.aerosol.Outputs(m) {
+			outputConc[name] = arr
+		}
+		// Fold sectional bin mass into the bulk fields before summing
+		// TotalPM2_5 and computing optics, so both stay consistent with
+		// the mass Run actually simulated instead of undercounting it.
+		m.aerosol.AddBulkMass(outputConc)
+	}
+
 	outputConc["TotalPM2_5"] = finalConc[iPM2_5].Copy()
 	outputConc["TotalPM2_5"].AddDense(outputConc["SOA"])
 	outputConc["TotalPM2_5"].AddDense(outputConc["pNH4"])
 	outputConc["TotalPM2_5"].AddDense(outputConc["pSO4"])
 	outputConc["TotalPM2_5"].AddDense(outputConc["pNO3"])
 
-	return
-}
+	if m.optics != nil {
+		opt := m.ComputeOptics(outputConc, m.optics.wavelengths, m.optics.tables)
+		mergeOpticsOutput(outputConc, opt)
+	}
 
-// Calculate emissions flux given emissions array in units of μg/s
-// and a scale for molecular mass conversion.
-func (m *MetData) calcEmisFlux(arr *sparse.DenseArray, scale float64) (
-	emisFlux *sparse.DenseArray) {
-	emisFlux = sparse.ZerosDense(m.Nz, m.Ny, m.Nx)
-	for k := 0; k < m.Nz; k++ {
-		for j := 0; j < m.Ny; j++ {
-			for i := 0; i < m.Nx; i++ {
-				fluxScale := 1. / m.Dx / m.Dy /
-					m.Dz.Get(k, j, i) * m.Dt // μg/s /m/m/m * s = μg/m3
-				emisFlux.Set(arr.Get(k, j, i)*scale*fluxScale, k, j, i)
-			}
-		}
+	report = RunReport{
+		Pollutant:  append([]string{}, polNames...),
+		FinalBias:  bias,
+		Converged:  polsConverged,
+		Iterations: iteration,
+		WallTime:   time.Since(startTime),
 	}
+
 	return
 }
 
@@ -228,12 +355,12 @@ func max(vals ...float64) float64 {
 	return m
 }
 
-func checkConvergence(newSum, oldSum float64, name string) bool {
-	bias := (newSum - oldSum) / oldSum
-	fmt.Printf("%v: difference = %3.2g%%\n", name, bias*100)
-	if bias > 0. || math.IsInf(bias,0) {
-		return false
-	} else {
-		return true
-	}
+// checkConvergence returns the relative bias between consecutive
+// iteration sums and whether that bias is within tol. oldSum is
+// floored at a small epsilon so a pollutant starting from zero doesn't
+// divide by zero.
+func checkConvergence(newSum, oldSum, tol float64) (bias float64, converged bool) {
+	const eps = 1.e-12
+	bias = (newSum - oldSum) / math.Max(math.Abs(oldSum), eps)
+	return bias, math.Abs(bias) < tol
 }
\ No newline at end of file